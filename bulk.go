@@ -0,0 +1,223 @@
+package mgohkp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	hkpstorage "gopkg.in/hockeypuck/hkp.v0/storage"
+	"gopkg.in/hockeypuck/openpgp.v0"
+)
+
+const (
+	defaultBulkBatchSize = 1000
+	// maxBulkBatchBytes keeps each batch comfortably under MongoDB's
+	// 16 MB BSON-per-write-operation limit, leaving headroom for the
+	// rest of each document's fields.
+	maxBulkBatchBytes = 15 * 1024 * 1024
+)
+
+// newKeyDoc builds the document Insert/BulkUpdate/Update write,
+// including the derived key ID fields used by Resolve.
+func newKeyDoc(key *openpgp.Pubkey, processID string) (keyDoc, error) {
+	var buf bytes.Buffer
+	if err := openpgp.WritePackets(&buf, key); err != nil {
+		return keyDoc{}, errgo.Mask(err)
+	}
+
+	keyID8, keyID16, subkeyFPs := keyIDFields(key)
+	now := time.Now().Unix()
+	return keyDoc{
+		CTime:        now,
+		MTime:        now,
+		RFingerprint: key.RFingerprint,
+		MD5:          key.MD5,
+		Keywords:     keywords(key),
+		Packets:      buf.Bytes(),
+		KeyID8:       keyID8,
+		KeyID16:      keyID16,
+		SubkeyFPs:    subkeyFPs,
+		ProcessID:    processID,
+	}, nil
+}
+
+// bulkBatches splits docs into runs that respect both batchSize and
+// maxBulkBatchBytes, the latter measured cumulatively over each doc's
+// packet bytes.
+func bulkBatches(docs []keyDoc, batchSize int) [][]keyDoc {
+	var batches [][]keyDoc
+	var batch []keyDoc
+	var batchBytes int
+
+	flush := func() {
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+			batch = nil
+			batchBytes = 0
+		}
+	}
+
+	for _, doc := range docs {
+		if len(batch) >= batchSize || (len(batch) > 0 && batchBytes+len(doc.Packets) > maxBulkBatchBytes) {
+			flush()
+		}
+		batch = append(batch, doc)
+		batchBytes += len(doc.Packets)
+	}
+	flush()
+
+	return batches
+}
+
+// DuplicateKeysError collects the per-rfingerprint hkpstorage.ErrDuplicate
+// errors raised by a bulk write, so a batch import can report every
+// collision instead of only the first one.
+type DuplicateKeysError []error
+
+func (e DuplicateKeysError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d duplicate key(s): %s", len(e), strings.Join(msgs, "; "))
+}
+
+// BulkUpdate implements BulkStorage.
+//
+// Unlike Update, which does an optimistic find-and-modify guarded by
+// the caller's last-known MD5, BulkUpdate replaces many existing
+// documents by rfingerprint in as few round-trips as possible. It's
+// meant for bulk resynchronization (e.g. replaying a keydump) rather
+// than single-key concurrent writers.
+func (st *storage) BulkUpdate(keys []*openpgp.Pubkey) error {
+	session, c := st.c()
+	defer session.Close()
+
+	docs := make([]keyDoc, 0, len(keys))
+	rfps := make([]string, 0, len(keys))
+	for _, key := range keys {
+		doc, err := newKeyDoc(key, st.processID)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := st.spillToGridFS(session, &doc); err != nil {
+			return errgo.Mask(err)
+		}
+		docs = append(docs, doc)
+		rfps = append(rfps, doc.RFingerprint)
+	}
+
+	oldGridFSIDs, err := st.lookupGridFSIDs(c, rfps)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	// oldGridFSIDs is only consulted for orphan cleanup once a batch's
+	// write has actually succeeded; see bulkInsertOrUpdate.
+	return st.bulkInsertOrUpdate(session, c, docs, true, oldGridFSIDs)
+}
+
+// lookupGridFSIDs fetches the GridFS file id (if any) each of the
+// given keys currently has on disk, so BulkUpdate can clean up a file
+// its write orphans.
+func (st *storage) lookupGridFSIDs(c *mgo.Collection, rfps []string) (map[string]bson.ObjectId, error) {
+	result := make(map[string]bson.ObjectId)
+	var doc keyDoc
+	iter := c.Find(bson.D{{"rfingerprint", bson.D{{"$in", rfps}}}}).
+		Select(bson.D{{"rfingerprint", 1}, {"packets_gridfs", 1}}).Iter()
+	for iter.Next(&doc) {
+		if doc.PacketsGridFS != "" {
+			result[doc.RFingerprint] = doc.PacketsGridFS
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// bulkInsertOrUpdate writes docs in batches via mgo's unordered Bulk
+// API. Duplicate-key collisions (on Insert) are collected into a
+// DuplicateKeysError and skipped rather than aborting the whole
+// batch; any other write failure aborts immediately. Notifications,
+// and any oldGridFSIDs orphan cleanup, only happen for documents a
+// batch actually wrote -- never speculatively before the write is
+// known to have succeeded.
+func (st *storage) bulkInsertOrUpdate(session *mgo.Session, c *mgo.Collection, docs []keyDoc, isUpdate bool, oldGridFSIDs map[string]bson.ObjectId) error {
+	var dupErrs DuplicateKeysError
+
+	for _, batch := range bulkBatches(docs, defaultBulkBatchSize) {
+		bulk := c.Bulk()
+		bulk.Unordered()
+		for i := range batch {
+			if isUpdate {
+				bulk.Update(bson.D{{"rfingerprint", batch[i].RFingerprint}}, bson.D{{"$set", bson.D{
+					{"mtime", batch[i].MTime},
+					{"md5", batch[i].MD5},
+					{"keywords", batch[i].Keywords},
+					{"packets", batch[i].Packets},
+					{"packets_gridfs", batch[i].PacketsGridFS},
+					{"keyid8", batch[i].KeyID8},
+					{"keyid16", batch[i].KeyID16},
+					{"subkey_fps", batch[i].SubkeyFPs},
+					{"process_id", batch[i].ProcessID},
+				}}})
+			} else {
+				bulk.Insert(&batch[i])
+			}
+		}
+
+		failed := make(map[int]bool)
+		_, err := bulk.Run()
+		if err != nil {
+			bulkErr, ok := err.(*mgo.BulkError)
+			if !ok {
+				return errgo.Mask(err)
+			}
+			for _, ecase := range bulkErr.Cases() {
+				if !mgo.IsDup(ecase.Err) {
+					return errgo.Mask(ecase.Err)
+				}
+				failed[ecase.Index] = true
+				dupErrs = append(dupErrs, hkpstorage.ErrDuplicate{
+					RFingerprint: batch[ecase.Index].RFingerprint,
+				})
+			}
+		}
+
+		for i, doc := range batch {
+			if failed[i] {
+				// This doc never made it into the collection (it lost a
+				// duplicate-key race), so any blob spillToGridFS already
+				// wrote for it is now an orphan with nothing pointing at
+				// it -- clean it up rather than leaking it.
+				if doc.PacketsGridFS != "" {
+					if err := st.removeOrphanedGridFSFile(session, doc.PacketsGridFS, ""); err != nil {
+						return errgo.Mask(err)
+					}
+				}
+				continue
+			}
+			if isUpdate {
+				st.Notify(hkpstorage.KeyReplaced{NewDigest: doc.MD5})
+				if oldID, ok := oldGridFSIDs[doc.RFingerprint]; ok {
+					if err := st.removeOrphanedGridFSFile(session, oldID, doc.PacketsGridFS); err != nil {
+						return errgo.Mask(err)
+					}
+				}
+			} else {
+				st.Notify(hkpstorage.KeyAdded{Digest: doc.MD5})
+			}
+		}
+	}
+
+	if len(dupErrs) > 0 {
+		return dupErrs
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package mgohkp_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+
+	"gopkg.in/mgo.v2"
+
+	pgp "gopkg.in/hockeypuck/openpgp.v0"
+
+	"gopkg.in/hockeypuck/mgohkp.v0"
+)
+
+// cannedKeyring is a batch of freshly generated OpenPGP entities,
+// serialized and re-parsed through the same reader FetchKeys uses, built
+// once in TestMain so every test/benchmark in this package measures
+// Insert/BulkUpdate's own cost rather than key generation.
+var cannedKeyring []*pgp.Pubkey
+
+func TestMain(m *testing.M) {
+	keys, err := buildCannedKeyring(500)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "building canned keyring: %v\n", err)
+		os.Exit(1)
+	}
+	cannedKeyring = keys
+	os.Exit(m.Run())
+}
+
+func buildCannedKeyring(n int) ([]*pgp.Pubkey, error) {
+	var result []*pgp.Pubkey
+	for i := 0; i < n; i++ {
+		entity, err := openpgp.NewEntity(
+			fmt.Sprintf("Bench Key %d", i), "", fmt.Sprintf("bench%d@example.com", i), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := entity.Serialize(&buf); err != nil {
+			return nil, err
+		}
+
+		c := pgp.ReadKeys(&buf)
+		for readKey := range c {
+			if readKey.Error != nil {
+				return nil, readKey.Error
+			}
+			result = append(result, readKey.Pubkey)
+		}
+	}
+	return result, nil
+}
+
+// dialTestStorage connects to a local mongod and returns a fresh
+// hkp.keys collection to exercise. It skips the test outright when no
+// mongod is reachable, since this package has no other way to run one.
+func dialTestStorage(t testing.TB) (*mgo.Session, mgohkp.BulkStorage) {
+	session, err := mgo.Dial("localhost")
+	if err != nil {
+		t.Skipf("no local mongod available: %v", err)
+	}
+	session.DB("hkp").DropDatabase()
+
+	st, err := mgohkp.NewStorage(session)
+	if err != nil {
+		session.Close()
+		t.Fatalf("NewStorage: %v", err)
+	}
+	return session, st
+}
+
+// TestBulkInsertThroughput imports the canned keyring both through a
+// single bulk Insert call and through the equivalent one-round-trip-
+// per-key loop Insert used before it was rewritten onto mgo's Bulk
+// API, and asserts the bulk path is actually faster -- the throughput
+// improvement the request that introduced BulkUpdate/Bulk Insert was
+// for.
+func TestBulkInsertThroughput(t *testing.T) {
+	session, st := dialTestStorage(t)
+	defer session.Close()
+	defer session.DB("hkp").DropDatabase()
+
+	session.DB("hkp").DropDatabase()
+	start := time.Now()
+	if err := st.Insert(cannedKeyring); err != nil {
+		t.Fatalf("bulk Insert: %v", err)
+	}
+	bulkElapsed := time.Since(start)
+
+	session.DB("hkp").DropDatabase()
+	start = time.Now()
+	for _, key := range cannedKeyring {
+		if err := st.Insert([]*pgp.Pubkey{key}); err != nil {
+			t.Fatalf("one-by-one Insert: %v", err)
+		}
+	}
+	oneByOneElapsed := time.Since(start)
+
+	t.Logf("bulk: %s for %d keys (%.0f keys/sec); one-by-one: %s (%.0f keys/sec)",
+		bulkElapsed, len(cannedKeyring), float64(len(cannedKeyring))/bulkElapsed.Seconds(),
+		oneByOneElapsed, float64(len(cannedKeyring))/oneByOneElapsed.Seconds())
+
+	if bulkElapsed >= oneByOneElapsed {
+		t.Errorf("expected bulk Insert to outperform one-by-one Insert; bulk=%s one-by-one=%s",
+			bulkElapsed, oneByOneElapsed)
+	}
+}
+
+// TestBulkUpdate exercises BulkUpdate and Close, both of which are
+// only reachable through mgohkp.BulkStorage rather than the plain
+// hkpstorage.Storage NewStorage used to return.
+func TestBulkUpdate(t *testing.T) {
+	session, st := dialTestStorage(t)
+	defer st.Close()
+	defer session.DB("hkp").DropDatabase()
+
+	if err := st.Insert(cannedKeyring[:1]); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := st.BulkUpdate(cannedKeyring[:1]); err != nil {
+		t.Fatalf("BulkUpdate: %v", err)
+	}
+}
+
+// BenchmarkInsert reports the bulk import rate on its own, so a future
+// change to the batching logic has a number to regress against.
+func BenchmarkInsert(b *testing.B) {
+	session, st := dialTestStorage(b)
+	defer session.Close()
+	defer session.DB("hkp").DropDatabase()
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		session.DB("hkp").DropDatabase()
+		if err := st.Insert(cannedKeyring); err != nil {
+			b.Fatalf("Insert: %v", err)
+		}
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.Logf("%d keys/op, %d ops, %.0f keys/sec overall",
+		len(cannedKeyring), b.N, float64(len(cannedKeyring)*b.N)/elapsed.Seconds())
+}
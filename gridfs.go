@@ -0,0 +1,77 @@
+package mgohkp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultGridFSThreshold is the packet blob size above which a key
+// spills into GridFS rather than being stored inline. It sits well
+// under MongoDB's 16 MB BSON document limit, since a heavily-signed
+// key's blob can otherwise push the whole keyDoc over it.
+const defaultGridFSThreshold = 8 * 1024 * 1024
+
+// gridFS returns the bucket packet blobs spill into: with the default
+// db/collection names, that's hkp.keys.files/hkp.keys.chunks.
+func (st *storage) gridFS(session *mgo.Session) *mgo.GridFS {
+	return session.DB(st.dbName).GridFS(st.collectionName)
+}
+
+// spillToGridFS writes doc.Packets to GridFS and replaces it with the
+// resulting file id on doc.PacketsGridFS when the blob is larger than
+// st.gridFSThreshold. Smaller keys are left stored inline, unchanged.
+func (st *storage) spillToGridFS(session *mgo.Session, doc *keyDoc) error {
+	if len(doc.Packets) <= st.gridFSThreshold {
+		return nil
+	}
+
+	file, err := st.gridFS(session).Create("")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := file.Write(doc.Packets); err != nil {
+		file.Close()
+		return errgo.Mask(err)
+	}
+	if err := file.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+
+	doc.PacketsGridFS = file.Id().(bson.ObjectId)
+	doc.Packets = nil
+	return nil
+}
+
+// removeOrphanedGridFSFile cleans up a revision's old GridFS file once
+// a write replaces it with either an inline blob or a new GridFS file
+// of its own. It's a no-op when there was no old file, or the new
+// write kept the same one.
+func (st *storage) removeOrphanedGridFSFile(session *mgo.Session, oldID, newID bson.ObjectId) error {
+	if oldID == "" || oldID == newID {
+		return nil
+	}
+	err := st.gridFS(session).RemoveId(oldID)
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// openPackets returns a reader over doc's packet blob, wherever it's
+// stored, so FetchKeys/FetchKeyrings can stream a GridFS-backed blob
+// into openpgp.ReadKeys without buffering it into memory first.
+func (st *storage) openPackets(session *mgo.Session, doc keyDoc) (io.ReadCloser, error) {
+	if doc.PacketsGridFS == "" {
+		return ioutil.NopCloser(bytes.NewReader(doc.Packets)), nil
+	}
+	file, err := st.gridFS(session).OpenId(doc.PacketsGridFS)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return file, nil
+}
@@ -0,0 +1,220 @@
+package mgohkp
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	hkpstorage "gopkg.in/hockeypuck/hkp.v0/storage"
+)
+
+const (
+	// defaultListenerBufferSize bounds how many undelivered KeyChange
+	// events a single slow listener can back up before Notify starts
+	// reporting its buffer as full.
+	defaultListenerBufferSize = 1024
+
+	notifyMaxAttempts = 5
+	notifyBackoffMin  = 100 * time.Millisecond
+	notifyBackoffMax  = 10 * time.Second
+
+	deadLetterCollName = "notify_deadletter"
+)
+
+// errNotifyBufferFull is returned by Notify when at least one
+// listener's buffer was full, so the writer can decide whether to
+// drop the event or apply backpressure instead of blocking on a slow
+// subscriber.
+var errNotifyBufferFull = errgo.New("mgohkp: listener buffer full, event dropped")
+
+// notifyListener pairs a subscribed callback with the bounded channel
+// and id its dedicated dispatcher goroutine drains.
+type notifyListener struct {
+	id string
+	f  func(hkpstorage.KeyChange) error
+	ch chan hkpstorage.KeyChange
+}
+
+// deadLetter is a KeyChange a listener failed to process after
+// notifyMaxAttempts attempts, persisted to hkp.notify_deadletter for
+// later inspection and replay via ReplayDeadLetter. KeyChange is
+// flattened into its two possible shapes rather than stored as the
+// interface itself, since bson can't decode back into an interface.
+type deadLetter struct {
+	ID         bson.ObjectId `bson:"_id,omitempty"`
+	ListenerID string        `bson:"listener_id"`
+	Timestamp  time.Time     `bson:"timestamp"`
+	LastError  string        `bson:"last_error"`
+	Kind       string        `bson:"kind"`
+	Digest     string        `bson:"digest,omitempty"`
+	OldDigest  string        `bson:"old_digest,omitempty"`
+	NewDigest  string        `bson:"new_digest,omitempty"`
+}
+
+func newDeadLetter(listenerID string, change hkpstorage.KeyChange, lastErr error) deadLetter {
+	dl := deadLetter{
+		ListenerID: listenerID,
+		Timestamp:  time.Now(),
+		LastError:  lastErr.Error(),
+	}
+	switch c := change.(type) {
+	case hkpstorage.KeyAdded:
+		dl.Kind = "added"
+		dl.Digest = c.Digest
+	case hkpstorage.KeyReplaced:
+		dl.Kind = "replaced"
+		dl.OldDigest = c.OldDigest
+		dl.NewDigest = c.NewDigest
+	}
+	return dl
+}
+
+func (dl deadLetter) keyChange() hkpstorage.KeyChange {
+	switch dl.Kind {
+	case "added":
+		return hkpstorage.KeyAdded{Digest: dl.Digest}
+	case "replaced":
+		return hkpstorage.KeyReplaced{OldDigest: dl.OldDigest, NewDigest: dl.NewDigest}
+	default:
+		return nil
+	}
+}
+
+// Subscribe implements storage.Storage.
+//
+// Each listener gets its own bounded channel and dispatcher goroutine,
+// so one slow or failing subscriber can't block Insert/Update, which
+// previously called every listener synchronously under st.mu.
+func (st *storage) Subscribe(f func(hkpstorage.KeyChange) error) {
+	l := &notifyListener{
+		id: bson.NewObjectId().Hex(),
+		f:  f,
+		ch: make(chan hkpstorage.KeyChange, defaultListenerBufferSize),
+	}
+
+	st.mu.Lock()
+	st.listeners = append(st.listeners, l)
+	st.mu.Unlock()
+
+	st.listenerWG.Add(1)
+	go func() {
+		defer st.listenerWG.Done()
+		st.drainListener(l)
+	}()
+}
+
+// Notify implements storage.Storage.
+//
+// It queues change on every listener's channel and returns immediately
+// once there's room; it never blocks waiting for a listener to drain.
+// If any listener's buffer is already full, the event is dropped for
+// that listener and Notify returns errNotifyBufferFull so the caller
+// can decide whether to retry, drop, or apply backpressure of its own.
+func (st *storage) Notify(change hkpstorage.KeyChange) error {
+	st.mu.Lock()
+	listeners := make([]*notifyListener, len(st.listeners))
+	copy(listeners, st.listeners)
+	st.mu.Unlock()
+
+	var full bool
+	for _, l := range listeners {
+		select {
+		case l.ch <- change:
+		default:
+			full = true
+		}
+	}
+	if full {
+		return errNotifyBufferFull
+	}
+	return nil
+}
+
+// drainListener is the body of each listener's dispatcher goroutine:
+// pull events off the channel and deliver them one at a time until
+// st.stopCh is closed.
+func (st *storage) drainListener(l *notifyListener) {
+	for {
+		select {
+		case <-st.stopCh:
+			return
+		case change, ok := <-l.ch:
+			if !ok {
+				return
+			}
+			st.deliver(l, change)
+		}
+	}
+}
+
+// deliver calls l.f with exponential backoff between attempts, giving
+// up and dead-lettering the event after notifyMaxAttempts failures.
+func (st *storage) deliver(l *notifyListener, change hkpstorage.KeyChange) {
+	backoff := notifyBackoffMin
+	var lastErr error
+	for attempt := 0; attempt < notifyMaxAttempts; attempt++ {
+		lastErr = l.f(change)
+		if lastErr == nil {
+			return
+		}
+
+		select {
+		case <-st.stopCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > notifyBackoffMax {
+			backoff = notifyBackoffMax
+		}
+	}
+
+	st.persistDeadLetter(l.id, change, lastErr)
+}
+
+func (st *storage) persistDeadLetter(listenerID string, change hkpstorage.KeyChange, lastErr error) {
+	session := st.Session.Copy()
+	defer session.Close()
+
+	dl := newDeadLetter(listenerID, change, lastErr)
+	c := session.DB(st.dbName).C(deadLetterCollName)
+	// Best-effort: if even the dead-letter write fails, there's
+	// nowhere left to surface it but the logs, and this package
+	// doesn't own a logger.
+	_ = c.Insert(&dl)
+}
+
+// ReplayDeadLetter implements BulkStorage. An event that fails again
+// is left in place for a later replay.
+func (st *storage) ReplayDeadLetter(listenerID string) error {
+	st.mu.Lock()
+	var target *notifyListener
+	for _, l := range st.listeners {
+		if l.id == listenerID {
+			target = l
+			break
+		}
+	}
+	st.mu.Unlock()
+	if target == nil {
+		return errgo.Newf("mgohkp: no such listener: %q", listenerID)
+	}
+
+	session := st.Session.Copy()
+	defer session.Close()
+	c := session.DB(st.dbName).C(deadLetterCollName)
+
+	var dl deadLetter
+	iter := c.Find(bson.D{{"listener_id", listenerID}}).Iter()
+	for iter.Next(&dl) {
+		if err := target.f(dl.keyChange()); err != nil {
+			continue
+		}
+		if err := c.RemoveId(dl.ID); err != nil {
+			iter.Close()
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(iter.Close())
+}
@@ -0,0 +1,215 @@
+package mgohkp
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	hkpstorage "gopkg.in/hockeypuck/hkp.v0/storage"
+)
+
+const (
+	oplogDBName        = "local"
+	oplogCollName      = "oplog.rs"
+	oplogStateCollName = "oplog_state"
+	oplogStateID       = "mgohkp"
+
+	oplogAwaitTimeout = 10 * time.Second
+	oplogBackoffMin   = 500 * time.Millisecond
+	oplogBackoffMax   = 30 * time.Second
+)
+
+// oplogEntry is the subset of a local.oplog.rs document this tailer
+// cares about. Only insert ("i") and update ("u") ops against the key
+// collection are relevant; deletes aren't used by this storage.
+type oplogEntry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Op        string              `bson:"op"`
+	NS        string              `bson:"ns"`
+	O         bson.M              `bson:"o"`
+}
+
+// oplogState is the single checkpoint document written to
+// hkp.oplog_state so a restarted tailer resumes after the last op it
+// applied instead of replaying the whole oplog.
+type oplogState struct {
+	ID        string              `bson:"_id"`
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+}
+
+// startOplogTailer launches the background goroutine that keeps this
+// node's listeners informed of KeyAdded/KeyReplaced events written by
+// peers sharing the same MongoDB deployment. It is started once by
+// NewStorage and stopped by Close.
+func (st *storage) startOplogTailer() {
+	st.oplogWG.Add(1)
+	go func() {
+		defer st.oplogWG.Done()
+		st.tailOplogLoop()
+	}()
+}
+
+// tailOplogLoop reopens the tailer with exponential backoff whenever
+// the cursor errors out (socket errors, cursor-not-found after a
+// capped collection rollover, replica set failover, etc), until
+// st.stopCh is closed.
+func (st *storage) tailOplogLoop() {
+	backoff := oplogBackoffMin
+	for {
+		select {
+		case <-st.stopCh:
+			return
+		default:
+		}
+
+		if err := st.tailOplogOnce(); err != nil {
+			select {
+			case <-st.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > oplogBackoffMax {
+				backoff = oplogBackoffMax
+			}
+			continue
+		}
+		backoff = oplogBackoffMin
+	}
+}
+
+// tailOplogOnce opens a single tailable cursor on local.oplog.rs,
+// restricted to this storage's key collection, and applies entries
+// until the cursor errors or st.stopCh is closed. A nil return only
+// happens when stopCh fires; any cursor error is returned for the
+// caller to retry.
+//
+// MongoDB >= 3.6 deployments support change streams, which avoid the
+// oplog's reversed/denormalized document shape; callers that run
+// against such a deployment should prefer wiring up a change stream
+// upstream and falling back to this tailer only when one isn't
+// available (e.g. standalone nodes, or servers too old to support
+// $changeStream aggregation).
+func (st *storage) tailOplogOnce() error {
+	session := st.Session.Copy()
+	defer session.Close()
+
+	resumeTS, err := st.loadOplogState(session)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	ns := st.dbName + "." + st.collectionName
+	oplog := session.DB(oplogDBName).C(oplogCollName)
+
+	for {
+		query := bson.D{{"ns", ns}}
+		if resumeTS != 0 {
+			query = bson.D{{"ns", ns}, {"ts", bson.D{{"$gt", resumeTS}}}}
+		}
+
+		iter := oplog.Find(query).LogReplay().Tail(oplogAwaitTimeout)
+
+		var entry oplogEntry
+		for iter.Next(&entry) {
+			if err := st.applyOplogEntry(session, entry); err != nil {
+				iter.Close()
+				return errgo.Mask(err)
+			}
+			resumeTS = entry.Timestamp
+
+			select {
+			case <-st.stopCh:
+				iter.Close()
+				return nil
+			default:
+			}
+		}
+		if err := iter.Err(); err != nil {
+			iter.Close()
+			return errgo.Mask(err)
+		}
+		if !iter.Timeout() {
+			iter.Close()
+			return errgo.New("oplog cursor closed by server")
+		}
+		iter.Close()
+
+		select {
+		case <-st.stopCh:
+			return nil
+		default:
+			// No new ops within oplogAwaitTimeout; reopen the cursor
+			// from the last checkpoint and keep waiting.
+		}
+	}
+}
+
+// applyOplogEntry decodes a single oplog op into a KeyChange and fans
+// it out through st.Notify, unless the op was written by this same
+// process (in which case Insert/Update already called Notify themselves).
+// The checkpoint is advanced regardless, so a duplicate or unrecognized
+// op never causes the tailer to replay it forever.
+func (st *storage) applyOplogEntry(session *mgo.Session, entry oplogEntry) error {
+	defer st.checkpointOplogState(session, entry.Timestamp)
+
+	// For an "i" op, O is the full inserted document; for a "u" op, O
+	// is the modifier document ({"$set": {...}} here, since that's the
+	// only form Insert/Update/BulkUpdate ever write), so process_id
+	// has to be read from underneath $set instead.
+	var pid string
+	switch entry.Op {
+	case "i":
+		pid, _ = entry.O["process_id"].(string)
+	case "u":
+		if set, ok := entry.O["$set"].(bson.M); ok {
+			pid, _ = set["process_id"].(string)
+		}
+	}
+	if pid != "" && pid == st.processID {
+		return nil
+	}
+
+	switch entry.Op {
+	case "i":
+		digest, _ := entry.O["md5"].(string)
+		if digest == "" {
+			return nil
+		}
+		return st.Notify(hkpstorage.KeyAdded{Digest: digest})
+	case "u":
+		set, _ := entry.O["$set"].(bson.M)
+		digest, _ := set["md5"].(string)
+		if digest == "" {
+			return nil
+		}
+		// The oplog only carries the post-image; the pre-image digest
+		// isn't recoverable without a separate read, so OldDigest is
+		// left blank for peer-originated updates.
+		return st.Notify(hkpstorage.KeyReplaced{NewDigest: digest})
+	}
+	return nil
+}
+
+func (st *storage) loadOplogState(session *mgo.Session) (bson.MongoTimestamp, error) {
+	c := session.DB(st.dbName).C(oplogStateCollName)
+	var state oplogState
+	err := c.FindId(oplogStateID).One(&state)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return state.Timestamp, nil
+}
+
+// checkpointOplogState persists the resume point after every applied
+// op. A failed checkpoint is not fatal: the next restart will simply
+// replay (and deduplicate) a few already-seen events.
+func (st *storage) checkpointOplogState(session *mgo.Session, ts bson.MongoTimestamp) {
+	c := session.DB(st.dbName).C(oplogStateCollName)
+	_, _ = c.UpsertId(oplogStateID, bson.D{{"$set", bson.D{{"ts", ts}}}})
+}
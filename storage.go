@@ -1,7 +1,7 @@
 package mgohkp
 
 import (
-	"bytes"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -26,26 +26,75 @@ type storage struct {
 	*mgo.Session
 	dbName, collectionName string
 
-	mu        sync.Mutex
-	listeners []func(hkpstorage.KeyChange) error
+	mu         sync.Mutex
+	listeners  []*notifyListener
+	listenerWG sync.WaitGroup
+
+	// processID tags locally-originated writes so the oplog tailer can
+	// recognize and skip its own inserts/updates when fanning out
+	// cluster-wide notifications.
+	processID string
+	stopCh    chan struct{}
+	oplogWG   sync.WaitGroup
+
+	// gridFSThreshold is the packet blob size, in bytes, above which
+	// Insert/Update/BulkUpdate spill into GridFS instead of storing the
+	// blob inline. See spillToGridFS.
+	gridFSThreshold int
 }
 
-var _ hkpstorage.Storage = (*storage)(nil)
+var _ BulkStorage = (*storage)(nil)
+
+// BulkStorage extends hkpstorage.Storage with the bulk-write and
+// lifecycle operations this backend adds on top of it. They aren't
+// part of hkpstorage.Storage, so NewStorage returns this interface,
+// letting a caller reach BulkUpdate, Close, and ReplayDeadLetter
+// without a type assertion.
+type BulkStorage interface {
+	hkpstorage.Storage
+
+	// BulkUpdate replaces many existing documents by rfingerprint in
+	// as few round-trips as possible; see the method doc for how it
+	// differs from Update.
+	BulkUpdate(keys []*openpgp.Pubkey) error
+
+	// Close stops the background oplog tailer and listener
+	// dispatchers, and releases the underlying mgo.Session. It must
+	// not be called more than once.
+	Close()
+
+	// ReplayDeadLetter re-delivers every dead-lettered KeyChange
+	// recorded for listenerID, removing each one as it's redelivered
+	// successfully.
+	ReplayDeadLetter(listenerID string) error
+}
 
 // NewStorage returns a MongoDB storage implementation for an HKP service.
-func NewStorage(session *mgo.Session) (hkpstorage.Storage, error) {
+func NewStorage(session *mgo.Session) (BulkStorage, error) {
 	st := &storage{
-		Session:        session,
-		dbName:         defaultDBName,
-		collectionName: defaultCollectionName,
+		Session:         session,
+		dbName:          defaultDBName,
+		collectionName:  defaultCollectionName,
+		processID:       bson.NewObjectId().Hex(),
+		stopCh:          make(chan struct{}),
+		gridFSThreshold: defaultGridFSThreshold,
 	}
 	err := st.createIndexes()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	st.startOplogTailer()
 	return st, nil
 }
 
+// Close implements BulkStorage.
+func (st *storage) Close() {
+	close(st.stopCh)
+	st.oplogWG.Wait()
+	st.listenerWG.Wait()
+	st.Session.Close()
+}
+
 func (st *storage) createIndexes() error {
 	session, c := st.c()
 	defer session.Close()
@@ -61,6 +110,19 @@ func (st *storage) createIndexes() error {
 	}, {
 		Key:        []string{"keywords"},
 		Background: true,
+	}, {
+		// keyid8/keyid16 are sparse but deliberately not unique: short and
+		// long key ID collisions between two genuinely different keys are
+		// a known occurrence on keyservers, and a unique index would make
+		// the second key permanently unimportable.
+		Key:    []string{"keyid8"},
+		Sparse: true,
+	}, {
+		Key:    []string{"keyid16"},
+		Sparse: true,
+	}, {
+		Key:        []string{"subkey_fps"},
+		Background: true,
 	}} {
 		err := c.EnsureIndex(index)
 		if err != nil {
@@ -80,8 +142,28 @@ type keyDoc struct {
 	CTime        int64    `bson:"ctime"`
 	MTime        int64    `bson:"mtime"`
 	MD5          string   `bson:"md5"`
-	Packets      []byte   `bson:"packets"`
+	Packets      []byte   `bson:"packets,omitempty"`
 	Keywords     []string `bson:"keywords"`
+
+	// PacketsGridFS holds the GridFS file id for this key's packet
+	// blob once it's grown too large to store inline in Packets; see
+	// spillToGridFS.
+	PacketsGridFS bson.ObjectId `bson:"packets_gridfs,omitempty"`
+
+	// KeyID8 and KeyID16 are the last 8/16 hex characters of the
+	// (non-reversed) fingerprint, precomputed so short and long key ID
+	// lookups in Resolve are an index hit rather than a regex scan.
+	KeyID8  string `bson:"keyid8,omitempty"`
+	KeyID16 string `bson:"keyid16,omitempty"`
+
+	// SubkeyFPs holds the reversed fingerprint of every subkey on this
+	// key, so Resolve can map a subkey ID back to its primary key.
+	SubkeyFPs []string `bson:"subkey_fps,omitempty"`
+
+	// ProcessID identifies the node that wrote this revision of the
+	// document, so the oplog tailer can tell its own writes apart from
+	// a peer's when deduplicating KeyChange notifications.
+	ProcessID string `bson:"process_id,omitempty"`
 }
 
 func (st *storage) MatchMD5(md5s []string) ([]string, error) {
@@ -108,8 +190,14 @@ func (st *storage) MatchMD5(md5s []string) ([]string, error) {
 
 // Resolve implements storage.Storage.
 //
-// Only v4 key IDs are resolved by this backend. v3 short and long key IDs
-// currently won't match.
+// Recognizes the three real HKP key ID forms: 8-hex short IDs and
+// 16-hex long IDs are matched against the precomputed keyid8/keyid16
+// fields, and 40-hex fingerprints are reversed and matched directly
+// against rfingerprint, so all three stay index-only lookups. Anything else
+// (an odd-length prefix) falls back to an anchored regex against
+// rfingerprint, as before. Every input is also checked against each
+// key's subkey_fps, so a subkey ID or fingerprint resolves to its
+// parent primary key, matching what SKS-style keyservers do.
 func (st *storage) Resolve(keyids []string) ([]string, error) {
 	session, c := st.c()
 	defer session.Close()
@@ -118,29 +206,61 @@ func (st *storage) Resolve(keyids []string) ([]string, error) {
 		keyids[i] = strings.ToLower(keyids[i])
 	}
 
-	var result []string
+	seen := make(map[string]bool)
 	var doc keyDoc
+	addMatches := func(query bson.D) error {
+		iter := c.Find(query).Iter()
+		for iter.Next(&doc) {
+			seen[doc.RFingerprint] = true
+		}
+		return errgo.Mask(iter.Close())
+	}
 
-	var regexes []string
+	var rfpRegexes, subkeyRegexes []bson.RegEx
 	for _, keyid := range keyids {
-		if len(keyid) < maxFingerprintLen {
-			regexes = append(regexes, "/^"+keyid+"/")
-		} else {
-			result = append(result, keyid)
+		// subkey_fps stores each subkey's *reversed* fingerprint, so a
+		// forward-order keyid has to be reversed before it can prefix-match
+		// it, the same way rfingerprint itself is derived from a fingerprint.
+		subkeyRegexes = append(subkeyRegexes, bson.RegEx{Pattern: "^" + reverseHex(keyid)})
+
+		var field, value string
+		switch len(keyid) {
+		case 8:
+			field, value = "keyid8", keyid
+		case 16:
+			field, value = "keyid16", keyid
+		case maxFingerprintLen:
+			field, value = "rfingerprint", reverseHex(keyid)
+		default:
+			// rfingerprint is a reversed fingerprint, same as subkey_fps
+			// above, so an odd-length prefix needs the same reversal
+			// before it can anchor-match it.
+			rfpRegexes = append(rfpRegexes, bson.RegEx{Pattern: "^" + reverseHex(keyid)})
+			continue
+		}
+
+		if err := addMatches(bson.D{{field, value}}); err != nil {
+			return nil, err
 		}
 	}
 
-	if len(regexes) > 0 {
-		iter := c.Find(bson.D{{"rfingerprint", bson.D{{"$in", regexes}}}}).Iter()
-		for iter.Next(&doc) {
-			result = append(result, doc.RFingerprint)
+	if len(rfpRegexes) > 0 {
+		if err := addMatches(bson.D{{"rfingerprint", bson.D{{"$in", rfpRegexes}}}}); err != nil {
+			return nil, err
 		}
-		err := iter.Close()
-		if err != nil {
-			return nil, errgo.Mask(err)
+	}
+	// subkey_fps isn't broken out into its own keyid8/keyid16 fields, so
+	// every input (not just odd-length ones) is matched here by regex.
+	if len(subkeyRegexes) > 0 {
+		if err := addMatches(bson.D{{"subkey_fps", bson.D{{"$in", subkeyRegexes}}}}); err != nil {
+			return nil, err
 		}
 	}
 
+	result := make([]string, 0, len(seen))
+	for rfp := range seen {
+		result = append(result, rfp)
+	}
 	return result, nil
 }
 
@@ -197,7 +317,7 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.Pubkey, error) {
 
 	iter := c.Find(bson.D{{"rfingerprint", bson.D{{"$in", rfps}}}}).Limit(100).Iter()
 	for iter.Next(&doc) {
-		pubkey, err := readOneKey(doc.Packets, doc.RFingerprint)
+		pubkey, err := st.readOneKeyDoc(session, doc)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
@@ -223,7 +343,7 @@ func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
 
 	iter := c.Find(bson.D{{"rfingerprint", bson.D{{"$in", rfps}}}}).Limit(100).Iter()
 	for iter.Next(&doc) {
-		pubkey, err := readOneKey(doc.Packets, doc.RFingerprint)
+		pubkey, err := st.readOneKeyDoc(session, doc)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
@@ -240,8 +360,21 @@ func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
 	return result, nil
 }
 
-func readOneKey(b []byte, rfingerprint string) (*openpgp.Pubkey, error) {
-	c := openpgp.ReadKeys(bytes.NewBuffer(b))
+// readOneKeyDoc opens doc's packet blob -- inline or in GridFS,
+// whichever it's stored in -- and reads it as a keyring without
+// buffering a GridFS-backed blob into memory first.
+func (st *storage) readOneKeyDoc(session *mgo.Session, doc keyDoc) (*openpgp.Pubkey, error) {
+	r, err := st.openPackets(session, doc)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer r.Close()
+
+	return readOneKey(r, doc.RFingerprint)
+}
+
+func readOneKey(r io.Reader, rfingerprint string) (*openpgp.Pubkey, error) {
+	c := openpgp.ReadKeys(r)
 	defer func() {
 		for _ = range c {
 		}
@@ -263,60 +396,61 @@ func readOneKey(b []byte, rfingerprint string) (*openpgp.Pubkey, error) {
 	return result, nil
 }
 
+// Insert implements storage.Storage.
+//
+// Keys are written in batches via mgo's Bulk API rather than one
+// round-trip per key, which is what made a keydump import of a few
+// hundred thousand keys I/O bound. See bulkInsertOrUpdate for the
+// batching and duplicate-handling details shared with BulkUpdate.
 func (st *storage) Insert(keys []*openpgp.Pubkey) error {
 	session, c := st.c()
 	defer session.Close()
 
+	docs := make([]keyDoc, 0, len(keys))
 	for _, key := range keys {
-		var buf bytes.Buffer
-		err := openpgp.WritePackets(&buf, key)
+		doc, err := newKeyDoc(key, st.processID)
 		if err != nil {
 			return errgo.Mask(err)
 		}
-
-		now := time.Now().Unix()
-		doc := keyDoc{
-			CTime:        now,
-			MTime:        now,
-			RFingerprint: key.RFingerprint,
-			MD5:          key.MD5,
-			Keywords:     keywords(key),
-			Packets:      buf.Bytes(),
-		}
-
-		err = c.Insert(&doc)
-		if err != nil {
+		if err := st.spillToGridFS(session, &doc); err != nil {
 			return errgo.Mask(err)
 		}
-		st.Notify(hkpstorage.KeyAdded{
-			Digest: key.MD5,
-		})
+		docs = append(docs, doc)
 	}
 
-	return nil
+	return st.bulkInsertOrUpdate(session, c, docs, false, nil)
 }
 
 func (st *storage) Update(key *openpgp.Pubkey, lastMD5 string) error {
-	var buf bytes.Buffer
-	err := openpgp.WritePackets(&buf, key)
+	session, c := st.c()
+	defer session.Close()
+
+	newDoc, err := newKeyDoc(key, st.processID)
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if err := st.spillToGridFS(session, &newDoc); err != nil {
+		return errgo.Mask(err)
+	}
 
-	now := time.Now().Unix()
 	update := bson.D{{"$set", bson.D{
-		{"mtime", now},
-		{"keywords", keywords(key)},
-		{"packets", buf.Bytes()},
+		{"mtime", newDoc.MTime},
+		{"md5", newDoc.MD5},
+		{"keywords", newDoc.Keywords},
+		{"packets", newDoc.Packets},
+		{"packets_gridfs", newDoc.PacketsGridFS},
+		{"keyid8", newDoc.KeyID8},
+		{"keyid16", newDoc.KeyID16},
+		{"subkey_fps", newDoc.SubkeyFPs},
+		{"process_id", newDoc.ProcessID},
 	}}}
 
-	session, c := st.c()
-	defer session.Close()
-
-	var doc keyDoc
+	// Apply defaults to returning the pre-image, which is exactly what
+	// we need to spot (and clean up) a GridFS file this write orphans.
+	var oldDoc keyDoc
 	info, err := c.Find(bson.D{{"md5", lastMD5}}).Apply(mgo.Change{
 		Update: update,
-	}, &doc)
+	}, &oldDoc)
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -325,6 +459,10 @@ func (st *storage) Update(key *openpgp.Pubkey, lastMD5 string) error {
 			key.MD5, lastMD5)
 	}
 
+	if err := st.removeOrphanedGridFSFile(session, oldDoc.PacketsGridFS, newDoc.PacketsGridFS); err != nil {
+		return errgo.Mask(err)
+	}
+
 	st.Notify(hkpstorage.KeyReplaced{
 		OldDigest: lastMD5,
 		NewDigest: key.MD5,
@@ -351,18 +489,34 @@ func keywords(key *openpgp.Pubkey) []string {
 	return result
 }
 
-func (st *storage) Subscribe(f func(hkpstorage.KeyChange) error) {
-	st.mu.Lock()
-	st.listeners = append(st.listeners, f)
-	st.mu.Unlock()
+// reverseHex reverses a hex string's character order, the same
+// transform used throughout this package to derive rfingerprint (and
+// subkey_fps) from a fingerprint.
+func reverseHex(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
 }
 
-func (st *storage) Notify(change hkpstorage.KeyChange) error {
-	st.mu.Lock()
-	defer st.mu.Unlock()
-	for _, f := range st.listeners {
-		// TODO: log error notifying listener?
-		f(change)
+// keyIDFields derives the fields Resolve relies on for fast key ID
+// lookups: the last 8/16 hex characters of the primary fingerprint
+// (the same way PGP tooling derives short/long key IDs), and the
+// reversed fingerprint of every subkey.
+func keyIDFields(key *openpgp.Pubkey) (keyID8, keyID16 string, subkeyFPs []string) {
+	fp := strings.ToLower(key.Fingerprint())
+	if len(fp) >= 8 {
+		keyID8 = fp[len(fp)-8:]
 	}
-	return nil
+	if len(fp) >= 16 {
+		keyID16 = fp[len(fp)-16:]
+	}
+	for _, subkey := range key.Subkeys {
+		if subkey == nil {
+			continue
+		}
+		subkeyFPs = append(subkeyFPs, strings.ToLower(subkey.RFingerprint))
+	}
+	return keyID8, keyID16, subkeyFPs
 }
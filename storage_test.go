@@ -0,0 +1,96 @@
+package mgohkp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+
+	pgp "gopkg.in/hockeypuck/openpgp.v0"
+)
+
+// TestReverseHex is a table test over the reversed-fingerprint
+// transform rfingerprint/subkey_fps are keyed on. Resolve's fallback
+// matching against both fields has twice been written with this
+// reversal applied to the wrong side (or skipped entirely), so this
+// pins down the transform itself.
+func TestReverseHex(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"a", "a"},
+		{"ab", "ba"},
+		{"abc", "cba"},
+		{"0123456789abcdef", "fedcba9876543210"},
+	}
+	for _, test := range tests {
+		if got := reverseHex(test.in); got != test.out {
+			t.Errorf("reverseHex(%q) = %q, want %q", test.in, got, test.out)
+		}
+		// Reversing twice must always round-trip.
+		if got := reverseHex(reverseHex(test.in)); got != test.in {
+			t.Errorf("reverseHex(reverseHex(%q)) = %q, want %q", test.in, got, test.in)
+		}
+	}
+}
+
+// genTestPubkey builds a single real *pgp.Pubkey by generating an
+// OpenPGP entity, serializing it, and re-parsing it through the
+// pgp.ReadKeys reader readOneKey uses -- the same round-trip bulk_test.go uses to
+// build its canned keyring, kept here too since keyIDFields needs a
+// real Fingerprint()/Subkeys rather than a hand-built fixture.
+func genTestPubkey(t *testing.T) *pgp.Pubkey {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity("Test Key", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("NewEntity: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := entity.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+
+	var result *pgp.Pubkey
+	for readKey := range pgp.ReadKeys(&buf) {
+		if readKey.Error != nil {
+			t.Fatalf("ReadKeys: %v", readKey.Error)
+		}
+		result = readKey.Pubkey
+	}
+	if result == nil {
+		t.Fatal("ReadKeys produced no key")
+	}
+	return result
+}
+
+// TestKeyIDFields checks that keyID8/keyID16 are the trailing hex of
+// the (forward) fingerprint Resolve matches keyid8/keyid16 against
+// directly, and that every subkey fingerprint it collects comes back
+// out reversed, matching how subkey_fps is queried in Resolve.
+func TestKeyIDFields(t *testing.T) {
+	key := genTestPubkey(t)
+
+	keyID8, keyID16, subkeyFPs := keyIDFields(key)
+
+	fp := strings.ToLower(key.Fingerprint())
+	if want := fp[len(fp)-8:]; keyID8 != want {
+		t.Errorf("keyID8 = %q, want %q", keyID8, want)
+	}
+	if want := fp[len(fp)-16:]; keyID16 != want {
+		t.Errorf("keyID16 = %q, want %q", keyID16, want)
+	}
+
+	if len(subkeyFPs) != len(key.Subkeys) {
+		t.Fatalf("got %d subkey fingerprints, want %d", len(subkeyFPs), len(key.Subkeys))
+	}
+	for i, subkey := range key.Subkeys {
+		want := strings.ToLower(subkey.RFingerprint)
+		if subkeyFPs[i] != want {
+			t.Errorf("subkeyFPs[%d] = %q, want %q", i, subkeyFPs[i], want)
+		}
+	}
+}